@@ -11,9 +11,12 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 
 	"encoding/json"
+	"encoding/xml"
 
 	"errors"
 
@@ -22,19 +25,26 @@ import (
 )
 
 type gocovercheck struct {
-	verbose          bool
-	requiredCoverage float64
-	coverprofile     string
-	testFlags        string
-	stdout           string
-	stderr           string
-	dirout string
+	verbose             bool
+	requiredCoverage    float64
+	coverprofile        string
+	testFlags           string
+	stdout              string
+	stderr              string
+	dirout              string
+	perPackageCoverage  string
+	integrationCoverdir bool
+	diffBase            string
+	reportFormat        string
+	reportOut           string
+	maxAttempts         int
 
 	logout  io.Writer
 	log     *log.Logger
 	cmdArgs []string
 
 	bestGuessPackageName string
+	coverDir             string
 
 	cmdRun func(*exec.Cmd) error
 
@@ -73,6 +83,17 @@ func init() {
 
 	flag.StringVar(&mainGoCoverCheck.dirout, "dirout", "", "If set, will change stdout, stderr, and coverprofile to all coexist inside dirout with arg default params")
 
+	flag.StringVar(&mainGoCoverCheck.perPackageCoverage, "per_package_coverage", "{}", "JSON map of package to required coverage, for example {\"./foo\": 80, \"./bar/...\": 50}.  Only enforced when a recursive or multi-package argument is given.")
+
+	flag.BoolVar(&mainGoCoverCheck.integrationCoverdir, "integration_coverdir", false, "If set, runs the test command with GOCOVERDIR set to a temp directory and merges the resulting binary coverage data (via `go tool covdata textfmt`) into the coverage profile.  Requires a Go 1.20+ toolchain.")
+
+	flag.StringVar(&mainGoCoverCheck.diffBase, "diff_base", "", "If set (e.g. origin/main), -required_coverage is checked against patch coverage -- coverage of only the lines changed relative to this git ref -- instead of whole-repo coverage.")
+
+	flag.StringVar(&mainGoCoverCheck.reportFormat, "report_format", "text", "Format for the coverage report written to -report_out: text, json, cobertura, or junit.")
+	flag.StringVar(&mainGoCoverCheck.reportOut, "report_out", "", "If set, write a structured coverage report in -report_format to this path.")
+
+	flag.IntVar(&mainGoCoverCheck.maxAttempts, "max_attempts", 1, "Number of times to run the test suite before failing.  On failure, retries are only attempted if every failing test is marked flaky with the flakytest package; anything else fails immediately.")
+
 	flag.BoolVar(&mainGoCoverCheck.verbose, "verbose", false, "If set, will send to stderr verbose logging out")
 }
 
@@ -143,6 +164,51 @@ func (g *gocovercheck) setupTempCoverProfile() error {
 	return nil
 }
 
+// mergeCoverDir converts the binary coverage data written to g.coverDir (GOCOVERDIR) into a
+// legacy-format profile via `go tool covdata textfmt`, then merges it with the profile already
+// produced by the -coverprofile flag on the same `go test` invocation, so the in-process coverage
+// gocovercheck was already tracking isn't discarded in favor of only the subprocess coverage.
+// g.coverprofile is pointed at the merged result.
+func (g *gocovercheck) mergeCoverDir() error {
+	covdataFile, err := ioutil.TempFile("", "gocovercheck-covdata")
+	if err != nil {
+		return wraperr(err, "unable to create covdata profile")
+	}
+	covdataFileName := covdataFile.Name()
+	if err := covdataFile.Close(); err != nil {
+		return wraperr(err, "unable to close covdata profile")
+	}
+	g.addCleanup(func() {
+		logIfErr(g.log, os.Remove(covdataFileName), "Unable to remove covdata profile file.")
+	})
+
+	cmd := exec.Command("go", "tool", "covdata", "textfmt", "-i="+g.coverDir, "-o="+covdataFileName)
+	cmd.Stdout = g.logout
+	cmd.Stderr = g.logout
+	g.log.Printf("Running cmd=[go tool covdata textfmt -i=%s -o=%s]\n", g.coverDir, covdataFileName)
+	if err := g.cmdRun(cmd); err != nil {
+		return wraperr(err, "go tool covdata textfmt failed")
+	}
+
+	mergedFile, err := ioutil.TempFile("", "gocovercheck-merged")
+	if err != nil {
+		return wraperr(err, "unable to create merged coverage profile")
+	}
+	mergedFileName := mergedFile.Name()
+	if err := mergedFile.Close(); err != nil {
+		return wraperr(err, "unable to close merged coverage profile")
+	}
+	g.addCleanup(func() {
+		logIfErr(g.log, os.Remove(mergedFileName), "Unable to remove merged coverage profile file.")
+	})
+
+	if err := mergeCoverageProfiles([]string{g.coverprofile, covdataFileName}, mergedFileName); err != nil {
+		return wraperr(err, "unable to merge GOCOVERDIR coverage with existing coverprofile")
+	}
+	g.coverprofile = mergedFileName
+	return nil
+}
+
 func (g *gocovercheck) setupRedirect(filename string, dash io.WriteCloser) (io.WriteCloser, error) {
 	stdout, err := forFile(filename, dash)
 	if err != nil {
@@ -176,13 +242,16 @@ func (g *gocovercheck) main() error {
 	}
 	g.bestGuessPackageName = filepath.Clean(wd)
 
-	if len(g.cmdArgs) > 1 {
-		return errors.New("Please only pass one directory to run tests inside\n")
+	if g.diffBase != "" && g.reportOut != "" {
+		return errors.New("-diff_base and -report_out/-report_format are not supported together")
 	}
-	cmdDir := ""
-	if len(g.cmdArgs) == 1 {
-		cmdDir = flag.Args()[0]
-		g.bestGuessPackageName = cmdDir
+
+	pkgDirs, recursive, err := g.resolvePackageDirs()
+	if err != nil {
+		return wraperr(err, "unable to resolve package arguments")
+	}
+	if len(pkgDirs) == 1 && pkgDirs[0] != "" {
+		g.bestGuessPackageName = pkgDirs[0]
 	}
 
 	if g.dirout != "" {
@@ -192,21 +261,10 @@ func (g *gocovercheck) main() error {
 		g.stdout = filepath.Join(g.dirout, fmt.Sprintf("%s.stdout.txt", bestGuessFilename))
 	}
 
-	cmd := "go"
-	args := []string{"test", "-covermode", "atomic"}
-	if g.coverprofile == "" {
-		if err := g.setupTempCoverProfile(); err != nil {
-			return wraperr(err, "unable to create temp cover profile")
-		}
-	}
-
-	args = append(args, g.setupBasicArgs()...)
-
 	params := make([]string, 0, 5)
 	if err := json.Unmarshal([]byte(g.testFlags), &params); err != nil {
 		return wraperr(err, "Invalid test flags.  Must be []string{}: %s", g.testFlags)
 	}
-	args = append(args, params...)
 
 	stdout, err := g.setupRedirect(g.stdout, os.Stdout)
 	if err != nil {
@@ -218,14 +276,386 @@ func (g *gocovercheck) main() error {
 		return wraperr(err, "Cannot open stderr pipe file")
 	}
 
+	if len(pkgDirs) > 1 || recursive {
+		if g.integrationCoverdir {
+			return errors.New("-integration_coverdir is not supported together with a recursive or multi-package argument")
+		}
+		if g.diffBase != "" {
+			return errors.New("-diff_base is not supported together with a recursive or multi-package argument")
+		}
+		if g.maxAttempts > 1 {
+			return errors.New("-max_attempts is not supported together with a recursive or multi-package argument")
+		}
+		return g.runMultiPackage(pkgDirs, params, stdout, stderr)
+	}
+
+	cmd := "go"
+	args := []string{"test", "-covermode", "atomic"}
+	if g.coverprofile == "" {
+		if err := g.setupTempCoverProfile(); err != nil {
+			return wraperr(err, "unable to create temp cover profile")
+		}
+	}
+
+	args = append(args, g.setupBasicArgs()...)
+	args = append(args, params...)
+
+	if g.integrationCoverdir {
+		if err := g.setupIntegrationCoverDir(); err != nil {
+			return wraperr(err, "unable to set up -integration_coverdir")
+		}
+	}
+
+	if g.maxAttempts > 1 {
+		coverArgs := []string{"-covermode", "atomic"}
+		coverArgs = append(coverArgs, g.setupBasicArgs()...)
+		retryErr := g.runTestsWithRetry(coverArgs, params, pkgDirs[0], stdout, stderr)
+		guessedPackageName := guessPackageName(g.log, g.coverprofile)
+		if guessedPackageName != defaultPackageName {
+			g.bestGuessPackageName = guessedPackageName
+		}
+		if retryErr != nil {
+			return retryErr
+		}
+		return g.afterTestRun()
+	}
+
 	e := exec.Command(cmd, args...)
 	e.Stdout = stdout
 	e.Stderr = stderr
-	e.Dir = cmdDir
+	e.Dir = pkgDirs[0]
+	if g.coverDir != "" {
+		e.Env = append(os.Environ(), "GOCOVERDIR="+g.coverDir)
+	}
 	g.log.Printf("Running cmd=[%s] args=[%v]\n", cmd, strings.Join(args, " "))
 	return g.runCmd(e)
 }
 
+// setupIntegrationCoverDir verifies the installed go toolchain supports GOCOVERDIR (Go 1.20+)
+// and creates the temp directory that will be exported as GOCOVERDIR to the test command.
+func (g *gocovercheck) setupIntegrationCoverDir() error {
+	supported, err := goToolchainSupportsCoverDir()
+	if err != nil {
+		return wraperr(err, "unable to determine go toolchain version")
+	}
+	if !supported {
+		return errors.New("-integration_coverdir requires a Go 1.20 or later toolchain")
+	}
+	coverDir, err := ioutil.TempDir("", "gocovercheck-coverdir")
+	if err != nil {
+		return wraperr(err, "unable to create GOCOVERDIR temp directory")
+	}
+	g.addCleanup(func() {
+		logIfErr(g.log, os.RemoveAll(coverDir), "Unable to remove GOCOVERDIR temp directory.")
+	})
+	g.coverDir = coverDir
+	return nil
+}
+
+var goVersionRegexp = regexp.MustCompile(`go(\d+)\.(\d+)`)
+
+func goToolchainSupportsCoverDir() (bool, error) {
+	out, err := exec.Command("go", "env", "GOVERSION").Output()
+	if err != nil {
+		return false, wraperr(err, "unable to run go env GOVERSION")
+	}
+	major, minor, err := parseGoVersion(string(out))
+	if err != nil {
+		return false, err
+	}
+	return major > 1 || (major == 1 && minor >= 20), nil
+}
+
+// parseGoVersion extracts the major and minor version out of the output of `go env GOVERSION`
+// (for example "go1.21.3\n").
+func parseGoVersion(goVersionOutput string) (major, minor int, err error) {
+	matches := goVersionRegexp.FindStringSubmatch(strings.TrimSpace(goVersionOutput))
+	if matches == nil {
+		return 0, 0, fmt.Errorf("unable to parse go toolchain version %q", strings.TrimSpace(goVersionOutput))
+	}
+	major, err = strconv.Atoi(matches[1])
+	if err != nil {
+		return 0, 0, wraperr(err, "unable to parse go major version")
+	}
+	minor, err = strconv.Atoi(matches[2])
+	if err != nil {
+		return 0, 0, wraperr(err, "unable to parse go minor version")
+	}
+	return major, minor, nil
+}
+
+// resolvePackageDirs turns the command line arguments into a concrete list of directories to
+// run `go test` inside.  A bare argument is used as-is (this is the historical behavior).  An
+// argument that is "..." or ends in "/..." (for example "./..." or "./foo/...") is expanded, the way `go list`
+// would, by walking the tree rooted at the part before "..." and collecting every directory that
+// contains Go files, skipping "_" and "."-prefixed directories along with "vendor".  The second
+// return value reports whether any argument was a recursive pattern, even if it happened to expand
+// to a single directory; -per_package_coverage only applies to recursive or multi-package arguments, so the caller
+// needs this regardless of how many directories came out the other end.
+func (g *gocovercheck) resolvePackageDirs() ([]string, bool, error) {
+	if len(g.cmdArgs) == 0 {
+		return []string{""}, false, nil
+	}
+	dirs := make([]string, 0, len(g.cmdArgs))
+	recursive := false
+	for _, arg := range g.cmdArgs {
+		if !isRecursivePattern(arg) {
+			dirs = append(dirs, arg)
+			continue
+		}
+		recursive = true
+		root := strings.TrimSuffix(strings.TrimSuffix(arg, "..."), "/")
+		if root == "" {
+			root = "."
+		}
+		found, err := findPackageDirs(root)
+		if err != nil {
+			return nil, false, wraperr(err, "unable to walk %s", root)
+		}
+		dirs = append(dirs, found...)
+	}
+	if len(dirs) == 0 {
+		return nil, false, errors.New("no packages found for the given arguments")
+	}
+	return dirs, recursive, nil
+}
+
+func isRecursivePattern(arg string) bool {
+	return arg == "..." || strings.HasSuffix(arg, "/...")
+}
+
+func findPackageDirs(root string) ([]string, error) {
+	var dirs []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		base := filepath.Base(path)
+		if path != root && (base == "vendor" || strings.HasPrefix(base, "_") || strings.HasPrefix(base, ".")) {
+			return filepath.SkipDir
+		}
+		hasGo, err := containsGoFiles(path)
+		if err != nil {
+			return err
+		}
+		if hasGo {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dirs, nil
+}
+
+func containsGoFiles(dir string) (bool, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".go") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// runMultiPackage runs `go test` once per package in pkgDirs, merges the resulting coverage
+// profiles into g.coverprofile, and enforces both the global -required_coverage and any matching
+// -per_package_coverage thresholds, reporting every package that fails rather than stopping at
+// the first one.
+func (g *gocovercheck) runMultiPackage(pkgDirs []string, params []string, stdout, stderr io.WriteCloser) error {
+	perPackageThresholds, err := parsePerPackageCoverage(g.perPackageCoverage)
+	if err != nil {
+		return wraperr(err, "invalid -per_package_coverage")
+	}
+
+	profileFiles := make([]string, 0, len(pkgDirs))
+	packageCoverage := make(map[string]float64, len(pkgDirs))
+	importPathToDir := make(map[string]string, len(pkgDirs))
+	for _, dir := range pkgDirs {
+		profileFile, err := ioutil.TempFile("", "gocovercheck")
+		if err != nil {
+			return wraperr(err, "unable to create temp cover profile for %s", dir)
+		}
+		profileFileName := profileFile.Name()
+		if err := profileFile.Close(); err != nil {
+			return wraperr(err, "unable to close temp cover profile for %s", dir)
+		}
+		g.addCleanup(func() {
+			logIfErr(g.log, os.Remove(profileFileName), "Unable to remove per package cover profile file.")
+		})
+
+		args := []string{"test", "-covermode", "atomic", "-coverprofile", profileFileName}
+		args = append(args, params...)
+		e := exec.Command("go", args...)
+		e.Stdout = stdout
+		e.Stderr = stderr
+		e.Dir = dir
+		g.log.Printf("Running cmd=[%s] args=[%v] dir=[%s]\n", "go", strings.Join(args, " "), dir)
+		if err := g.cmdRun(e); err != nil {
+			return wraperr(err, "test command did not run correctly for %s", dir)
+		}
+
+		coverage, err := calculateCoverage(profileFileName)
+		if err != nil {
+			return wraperr(err, "cannot load coverage profile file for %s", dir)
+		}
+		g.log.Printf("Calculated coverage %.2f for %s\n", coverage, dir)
+		packageCoverage[dir] = coverage
+		profileFiles = append(profileFiles, profileFileName)
+
+		profiles, err := cover.ParseProfiles(profileFileName)
+		if err != nil {
+			return wraperr(err, "cannot parse coverage profile file for %s", dir)
+		}
+		for _, profile := range profiles {
+			importPathToDir[filepath.Dir(profile.FileName)] = dir
+		}
+	}
+
+	if g.coverprofile == "" {
+		if err := g.setupTempCoverProfile(); err != nil {
+			return wraperr(err, "unable to create temp cover profile")
+		}
+	}
+	if err := mergeCoverageProfiles(profileFiles, g.coverprofile); err != nil {
+		return wraperr(err, "unable to merge coverage profiles")
+	}
+
+	var failures []string
+	result, err := buildCoverageResult(g.coverprofile, g.requiredCoverage, perPackageThresholds, importPathToDir)
+	if err != nil {
+		return wraperr(err, "cannot load merged coverage profile file")
+	}
+	g.log.Printf("Calculated total coverage %.2f\n", result.Coverage)
+	if !result.Passed {
+		failures = append(failures, fmt.Sprintf("total coverage %.4f less than required %.4f", result.Coverage, g.requiredCoverage))
+	}
+
+	for dir, coverage := range packageCoverage {
+		for pattern, threshold := range perPackageThresholds {
+			if !packagePatternMatches(dir, pattern) {
+				continue
+			}
+			if coverage+.001 < threshold {
+				failures = append(failures, fmt.Sprintf("%s coverage %.4f less than required %.4f", dir, coverage, threshold))
+			}
+		}
+	}
+	sort.Strings(failures)
+
+	if err := writeCoverageReport(g.reportFormat, g.reportOut, result); err != nil {
+		return wraperr(err, "unable to write coverage report")
+	}
+
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func parsePerPackageCoverage(raw string) (map[string]float64, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	thresholds := make(map[string]float64)
+	if err := json.Unmarshal([]byte(raw), &thresholds); err != nil {
+		return nil, err
+	}
+	return thresholds, nil
+}
+
+func packagePatternMatches(pkgDir, pattern string) bool {
+	pkgDir = normalizePackageDir(pkgDir)
+	if strings.HasSuffix(pattern, "/...") {
+		prefix := normalizePackageDir(strings.TrimSuffix(pattern, "/..."))
+		return pkgDir == prefix || strings.HasPrefix(pkgDir, prefix+"/")
+	}
+	return pkgDir == normalizePackageDir(pattern)
+}
+
+func normalizePackageDir(p string) string {
+	p = filepath.Clean(p)
+	if p == "." || p == "" {
+		return "."
+	}
+	if !strings.HasPrefix(p, "./") && !strings.HasPrefix(p, "/") {
+		p = "./" + p
+	}
+	return p
+}
+
+type coverageBlockKey struct {
+	startLine, startCol, endLine, endCol int
+}
+
+// mergeCoverageProfiles parses each profile in profileFiles and writes a single "mode: atomic"
+// profile to out, summing Count for blocks that share the same file and position.
+func mergeCoverageProfiles(profileFiles []string, out string) error {
+	fileOrder := make([]string, 0, len(profileFiles))
+	merged := make(map[string]map[coverageBlockKey]*cover.ProfileBlock)
+	for _, profileFile := range profileFiles {
+		profiles, err := cover.ParseProfiles(profileFile)
+		if err != nil {
+			return wraperr(err, "cannot parse coverage profile file %s", profileFile)
+		}
+		for _, profile := range profiles {
+			blocks, ok := merged[profile.FileName]
+			if !ok {
+				blocks = make(map[coverageBlockKey]*cover.ProfileBlock)
+				merged[profile.FileName] = blocks
+				fileOrder = append(fileOrder, profile.FileName)
+			}
+			for _, block := range profile.Blocks {
+				key := coverageBlockKey{block.StartLine, block.StartCol, block.EndLine, block.EndCol}
+				if existing, ok := blocks[key]; ok {
+					existing.Count += block.Count
+					continue
+				}
+				blockCopy := block
+				blocks[key] = &blockCopy
+			}
+		}
+	}
+	sort.Strings(fileOrder)
+
+	w, err := os.Create(out)
+	if err != nil {
+		return wraperr(err, "cannot create merged coverage profile %s", out)
+	}
+	if _, err := fmt.Fprintln(w, "mode: atomic"); err != nil {
+		w.Close()
+		return wraperr(err, "cannot write merged coverage profile mode line")
+	}
+	for _, fileName := range fileOrder {
+		blocks := merged[fileName]
+		keys := make([]coverageBlockKey, 0, len(blocks))
+		for key := range blocks {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].startLine != keys[j].startLine {
+				return keys[i].startLine < keys[j].startLine
+			}
+			return keys[i].startCol < keys[j].startCol
+		})
+		for _, key := range keys {
+			block := blocks[key]
+			if _, err := fmt.Fprintf(w, "%s:%d.%d,%d.%d %d %d\n", fileName, block.StartLine, block.StartCol, block.EndLine, block.EndCol, block.NumStmt, block.Count); err != nil {
+				w.Close()
+				return wraperr(err, "cannot write merged coverage profile block")
+			}
+		}
+	}
+	return w.Close()
+}
+
 func (g *gocovercheck) runCmd(e *exec.Cmd) error {
 	runErr := g.cmdRun(e)
 	guessedPackageName := guessPackageName(g.log, g.coverprofile)
@@ -236,13 +666,36 @@ func (g *gocovercheck) runCmd(e *exec.Cmd) error {
 		return wraperr(runErr, "test command did not run correctly")
 	}
 	g.log.Printf("Finished running command\n")
-	coverage, err := calculateCoverage(g.coverprofile)
+	return g.afterTestRun()
+}
+
+// afterTestRun runs everything that happens once the test command has exited zero: merging any
+// GOCOVERDIR data, then either enforcing diff coverage or computing and reporting whole-profile
+// coverage.  It is shared by the single invocation in runCmd and by main once
+// runTestsWithRetry has succeeded.
+func (g *gocovercheck) afterTestRun() error {
+	if g.coverDir != "" {
+		if err := g.mergeCoverDir(); err != nil {
+			return wraperr(err, "unable to merge GOCOVERDIR coverage data")
+		}
+	}
+	if g.diffBase != "" {
+		return g.enforceDiffCoverage()
+	}
+	perPackageThresholds, err := parsePerPackageCoverage(g.perPackageCoverage)
+	if err != nil {
+		return wraperr(err, "invalid -per_package_coverage")
+	}
+	result, err := buildCoverageResult(g.coverprofile, g.requiredCoverage, perPackageThresholds, nil)
 	if err != nil {
 		return wraperr(err, "cannot load coverage profile file")
 	}
-	g.log.Printf("Calculated coverage %.2f\n", coverage)
-	if coverage+.001 < g.requiredCoverage {
-		return fmt.Errorf("Code coverage %.4f less than required %.4f", coverage, g.requiredCoverage)
+	g.log.Printf("Calculated coverage %.2f\n", result.Coverage)
+	if err := writeCoverageReport(g.reportFormat, g.reportOut, result); err != nil {
+		return wraperr(err, "unable to write coverage report")
+	}
+	if !result.Passed {
+		return fmt.Errorf("Code coverage %.4f less than required %.4f", result.Coverage, g.requiredCoverage)
 	}
 	return nil
 }
@@ -296,3 +749,531 @@ func calculateCoverage(coverprofile string) (float64, error) {
 	}
 	return float64(covered) / float64(total) * 100, nil
 }
+
+// enforceDiffCoverage checks g.requiredCoverage against patch coverage -- coverage of only the
+// blocks that intersect lines added or modified relative to g.diffBase -- instead of whole-repo
+// coverage, and lists every uncovered new line so a developer can jump straight to it.
+func (g *gocovercheck) enforceDiffCoverage() error {
+	diffRanges, err := gitDiffRanges(g.diffBase)
+	if err != nil {
+		return wraperr(err, "unable to compute diff ranges against %s", g.diffBase)
+	}
+	profiles, err := cover.ParseProfiles(g.coverprofile)
+	if err != nil {
+		return wraperr(err, "cannot parse coverage profile file %s", g.coverprofile)
+	}
+	coverage, uncoveredLines := calculateDiffCoverage(profiles, diffRanges)
+	g.log.Printf("Calculated diff coverage %.2f against %s\n", coverage, g.diffBase)
+	if coverage+.001 < g.requiredCoverage {
+		msg := fmt.Sprintf("Patch coverage %.4f less than required %.4f", coverage, g.requiredCoverage)
+		if len(uncoveredLines) > 0 {
+			msg = fmt.Sprintf("%s; uncovered lines: %s", msg, strings.Join(uncoveredLines, ", "))
+		}
+		return errors.New(msg)
+	}
+	return nil
+}
+
+type lineRange struct {
+	start, end int
+}
+
+var diffHunkRegexp = regexp.MustCompile(`^@@ -\d+(?:,\d+)? \+(\d+)(?:,(\d+))? @@`)
+
+// gitDiffRanges shells out to `git diff --unified=0 <base>...HEAD` and returns the added/modified
+// line ranges per file.
+func gitDiffRanges(base string) (map[string][]lineRange, error) {
+	out, err := exec.Command("git", "diff", "--unified=0", base+"...HEAD").Output()
+	if err != nil {
+		return nil, wraperr(err, "unable to run git diff against %s", base)
+	}
+	return parseDiffRanges(out), nil
+}
+
+func parseDiffRanges(diff []byte) map[string][]lineRange {
+	ranges := make(map[string][]lineRange)
+	currentFile := ""
+	scanner := bufio.NewScanner(bytes.NewReader(diff))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "+++ "):
+			file := strings.TrimPrefix(line, "+++ ")
+			file = strings.TrimPrefix(file, "b/")
+			if file == "/dev/null" {
+				currentFile = ""
+			} else {
+				currentFile = file
+			}
+		case strings.HasPrefix(line, "@@ "):
+			if currentFile == "" {
+				continue
+			}
+			matches := diffHunkRegexp.FindStringSubmatch(line)
+			if matches == nil {
+				continue
+			}
+			start, err := strconv.Atoi(matches[1])
+			if err != nil {
+				continue
+			}
+			count := 1
+			if matches[2] != "" {
+				count, err = strconv.Atoi(matches[2])
+				if err != nil {
+					continue
+				}
+			}
+			if count == 0 {
+				continue
+			}
+			ranges[currentFile] = append(ranges[currentFile], lineRange{start: start, end: start + count - 1})
+		}
+	}
+	return ranges
+}
+
+// calculateDiffCoverage computes coverage restricted to blocks that intersect diffRanges, and
+// returns every uncovered line within those ranges as "file:line" for error reporting.
+func calculateDiffCoverage(profiles []*cover.Profile, diffRanges map[string][]lineRange) (float64, []string) {
+	total := 0
+	covered := 0
+	var uncoveredLines []string
+	for _, profile := range profiles {
+		ranges, matched := matchDiffRanges(profile.FileName, diffRanges)
+		if !matched {
+			continue
+		}
+		for _, block := range profile.Blocks {
+			overlaps := false
+			for line := block.StartLine; line <= block.EndLine; line++ {
+				if !lineInRanges(line, ranges) {
+					continue
+				}
+				overlaps = true
+				if block.Count == 0 {
+					uncoveredLines = append(uncoveredLines, fmt.Sprintf("%s:%d", profile.FileName, line))
+				}
+			}
+			if !overlaps {
+				continue
+			}
+			total += block.NumStmt
+			if block.Count > 0 {
+				covered += block.NumStmt
+			}
+		}
+	}
+	sort.Strings(uncoveredLines)
+	if total == 0 {
+		return 100.0, uncoveredLines
+	}
+	return float64(covered) / float64(total) * 100, uncoveredLines
+}
+
+func matchDiffRanges(profileFileName string, diffRanges map[string][]lineRange) ([]lineRange, bool) {
+	profileFileName = filepath.ToSlash(profileFileName)
+	for diffPath, ranges := range diffRanges {
+		diffPath = filepath.ToSlash(diffPath)
+		if profileFileName == diffPath || strings.HasSuffix(profileFileName, "/"+diffPath) {
+			return ranges, true
+		}
+	}
+	return nil, false
+}
+
+func lineInRanges(line int, ranges []lineRange) bool {
+	for _, r := range ranges {
+		if line >= r.start && line <= r.end {
+			return true
+		}
+	}
+	return false
+}
+
+type fileCoverageResult struct {
+	FileName   string `json:"fileName"`
+	Statements int    `json:"statements"`
+	Covered    int    `json:"covered"`
+}
+
+type packageCoverageResult struct {
+	Name       string  `json:"name"`
+	Statements int     `json:"statements"`
+	Covered    int     `json:"covered"`
+	Coverage   float64 `json:"coverage"`
+	Required   float64 `json:"required"`
+	Passed     bool    `json:"passed"`
+}
+
+type coverageResult struct {
+	RequiredCoverage float64                 `json:"requiredCoverage"`
+	Coverage         float64                 `json:"coverage"`
+	Passed           bool                    `json:"passed"`
+	Files            []fileCoverageResult    `json:"files"`
+	Packages         []packageCoverageResult `json:"packages"`
+}
+
+// buildCoverageResult parses coverprofile once and aggregates it into per-file statement counts
+// and per-package percentages, applying perPackageThresholds (falling back to requiredCoverage)
+// so both the stdout warning and the -report_out reporters can consume a single structured value.
+//
+// perPackageThresholds is keyed by the CLI-relative directories -per_package_coverage patterns use
+// (for example "./foo"), but coverprofile's package names come from cover.Profile.FileName, which
+// is import-path qualified (for example "github.com/org/repo/foo").  importPathToDir translates
+// between the two -- built by runMultiPackage from the directory it actually ran `go test` in for
+// each package -- so a package's Required/Passed are computed against the same name its threshold
+// was matched under. It may be nil, in which case thresholds are matched against the import-path
+// name directly (the pre-existing behavior for a single, non-recursive package argument).
+func buildCoverageResult(coverprofile string, requiredCoverage float64, perPackageThresholds map[string]float64, importPathToDir map[string]string) (*coverageResult, error) {
+	profiles, err := cover.ParseProfiles(coverprofile)
+	if err != nil {
+		return nil, wraperr(err, "cannot parse coverage profile file %s", coverprofile)
+	}
+
+	fileStats := make(map[string]*fileCoverageResult)
+	fileOrder := make([]string, 0)
+	packageStats := make(map[string]*packageCoverageResult)
+	packageOrder := make([]string, 0)
+	total := 0
+	covered := 0
+
+	for _, profile := range profiles {
+		file, ok := fileStats[profile.FileName]
+		if !ok {
+			file = &fileCoverageResult{FileName: profile.FileName}
+			fileStats[profile.FileName] = file
+			fileOrder = append(fileOrder, profile.FileName)
+		}
+		pkgName := filepath.Dir(profile.FileName)
+		pkg, ok := packageStats[pkgName]
+		if !ok {
+			matchName := pkgName
+			if dir, ok := importPathToDir[pkgName]; ok {
+				matchName = dir
+			}
+			pkg = &packageCoverageResult{Name: pkgName, Required: requiredCoverage}
+			for pattern, threshold := range perPackageThresholds {
+				if packagePatternMatches(matchName, pattern) {
+					pkg.Required = threshold
+				}
+			}
+			packageStats[pkgName] = pkg
+			packageOrder = append(packageOrder, pkgName)
+		}
+		for _, block := range profile.Blocks {
+			file.Statements += block.NumStmt
+			pkg.Statements += block.NumStmt
+			total += block.NumStmt
+			if block.Count > 0 {
+				file.Covered += block.NumStmt
+				pkg.Covered += block.NumStmt
+				covered += block.NumStmt
+			}
+		}
+	}
+
+	sort.Strings(fileOrder)
+	sort.Strings(packageOrder)
+
+	files := make([]fileCoverageResult, 0, len(fileOrder))
+	for _, name := range fileOrder {
+		files = append(files, *fileStats[name])
+	}
+	packages := make([]packageCoverageResult, 0, len(packageOrder))
+	for _, name := range packageOrder {
+		pkg := packageStats[name]
+		pkg.Coverage = rate(pkg.Covered, pkg.Statements) * 100
+		pkg.Passed = pkg.Coverage+.001 >= pkg.Required
+		packages = append(packages, *pkg)
+	}
+
+	coverage := rate(covered, total) * 100
+	return &coverageResult{
+		RequiredCoverage: requiredCoverage,
+		Coverage:         coverage,
+		Passed:           coverage+.001 >= requiredCoverage,
+		Files:            files,
+		Packages:         packages,
+	}, nil
+}
+
+func rate(covered, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(covered) / float64(total)
+}
+
+// writeCoverageReport writes result to out in format (text, json, cobertura, or junit).  It is a
+// no-op when out is empty, since -report_out is opt-in.
+func writeCoverageReport(format, out string, result *coverageResult) error {
+	if out == "" {
+		return nil
+	}
+	var data []byte
+	var err error
+	switch format {
+	case "", "text":
+		data = []byte(textCoverageReport(result))
+	case "json":
+		data, err = json.MarshalIndent(result, "", "  ")
+	case "cobertura":
+		data, err = coberturaCoverageReport(result)
+	case "junit":
+		data, err = junitCoverageReport(result)
+	default:
+		return fmt.Errorf("unknown -report_format %q", format)
+	}
+	if err != nil {
+		return wraperr(err, "unable to build coverage report")
+	}
+	if err := ioutil.WriteFile(out, data, 0644); err != nil {
+		return wraperr(err, "unable to write coverage report to %s", out)
+	}
+	return nil
+}
+
+func textCoverageReport(result *coverageResult) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "coverage: %.4f required: %.4f passed: %t\n", result.Coverage, result.RequiredCoverage, result.Passed)
+	for _, pkg := range result.Packages {
+		fmt.Fprintf(&b, "%s: %.4f required: %.4f passed: %t\n", pkg.Name, pkg.Coverage, pkg.Required, pkg.Passed)
+	}
+	return b.String()
+}
+
+type coberturaReport struct {
+	XMLName  xml.Name           `xml:"coverage"`
+	LineRate float64            `xml:"line-rate,attr"`
+	Version  string             `xml:"version,attr"`
+	Packages []coberturaPackage `xml:"packages>package"`
+}
+
+type coberturaPackage struct {
+	Name     string           `xml:"name,attr"`
+	LineRate float64          `xml:"line-rate,attr"`
+	Classes  []coberturaClass `xml:"classes>class"`
+}
+
+type coberturaClass struct {
+	Name     string  `xml:"name,attr"`
+	FileName string  `xml:"filename,attr"`
+	LineRate float64 `xml:"line-rate,attr"`
+}
+
+func coberturaCoverageReport(result *coverageResult) ([]byte, error) {
+	report := coberturaReport{
+		LineRate: result.Coverage / 100,
+		Version:  "1",
+	}
+	for _, pkg := range result.Packages {
+		cpkg := coberturaPackage{Name: pkg.Name, LineRate: rate(pkg.Covered, pkg.Statements)}
+		for _, file := range result.Files {
+			if filepath.Dir(file.FileName) != pkg.Name {
+				continue
+			}
+			cpkg.Classes = append(cpkg.Classes, coberturaClass{
+				Name:     file.FileName,
+				FileName: file.FileName,
+				LineRate: rate(file.Covered, file.Statements),
+			})
+		}
+		report.Packages = append(report.Packages, cpkg)
+	}
+	body, err := xml.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), body...), nil
+}
+
+type junitTestsuite struct {
+	XMLName   xml.Name        `xml:"testsuite"`
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	TestCases []junitTestcase `xml:"testcase"`
+}
+
+type junitTestcase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// junitCoverageReport emits one <testcase> per package with a <failure> element when that
+// package is below its threshold, so CI systems that parse JUnit XML surface coverage gaps the
+// same way they surface test failures.
+func junitCoverageReport(result *coverageResult) ([]byte, error) {
+	suite := junitTestsuite{Name: "gocovercheck", Tests: len(result.Packages)}
+	for _, pkg := range result.Packages {
+		tc := junitTestcase{ClassName: "gocovercheck", Name: pkg.Name}
+		if !pkg.Passed {
+			suite.Failures++
+			tc.Failure = &junitFailure{
+				Message: fmt.Sprintf("coverage %.4f less than required %.4f", pkg.Coverage, pkg.Required),
+				Text:    fmt.Sprintf("%s coverage %.4f less than required %.4f", pkg.Name, pkg.Coverage, pkg.Required),
+			}
+		}
+		suite.TestCases = append(suite.TestCases, tc)
+	}
+	body, err := xml.MarshalIndent(suite, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), body...), nil
+}
+
+// flakyMarker is written via t.Log by flakytest.Mark and is how runTestsWithRetry recognizes,
+// from `go test -json` output, which failing tests are eligible for retry.
+const flakyMarker = "flakytest: marked as flaky"
+
+// runTestsWithRetry runs `go test -json` for pkgDir up to g.maxAttempts times in all, each retry narrowing
+// -run to only the tests that failed on the previous attempt.  A failing test is only retried if
+// it logged flakyMarker (via flakytest.Mark); any other failure is returned immediately.  Only
+// the first attempt passes coverArgs, since later attempts only re-run the previously failing
+// subset and would otherwise overwrite the coverage profile with partial data.
+func (g *gocovercheck) runTestsWithRetry(coverArgs, params []string, pkgDir string, stdout, stderr io.WriteCloser) error {
+	var retried []string
+	var failed []string
+	for attempt := 1; ; attempt++ {
+		args := []string{"test", "-json"}
+		if attempt == 1 {
+			args = append(args, coverArgs...)
+		}
+		args = append(args, params...)
+		if attempt > 1 {
+			args = append(args, "-run", testRunPattern(failed))
+		}
+
+		var jsonBuf bytes.Buffer
+		e := exec.Command("go", args...)
+		e.Stdout = io.MultiWriter(stdout, &jsonBuf)
+		e.Stderr = stderr
+		e.Dir = pkgDir
+		if g.coverDir != "" {
+			e.Env = append(os.Environ(), "GOCOVERDIR="+g.coverDir)
+		}
+		g.log.Printf("Running cmd=[go] args=[%v] attempt=%d\n", strings.Join(args, " "), attempt)
+		runErr := g.cmdRun(e)
+
+		var flaky map[string]bool
+		failed, flaky = parseFailedTests(jsonBuf.Bytes())
+		if runErr == nil {
+			if len(retried) > 0 {
+				g.log.Printf("Tests passed after retrying flaky test(s): %s\n", strings.Join(retried, ", "))
+			}
+			return nil
+		}
+		if len(failed) == 0 {
+			return wraperr(runErr, "test command did not run correctly")
+		}
+
+		var unflaky []string
+		for _, name := range failed {
+			if !failedNameIsFlaky(name, failed, flaky) {
+				unflaky = append(unflaky, name)
+			}
+		}
+		if len(unflaky) > 0 {
+			return wraperr(runErr, "test(s) failed and are not marked flaky: %s", strings.Join(unflaky, ", "))
+		}
+		if attempt >= g.maxAttempts {
+			return wraperr(runErr, "flaky test(s) still failing after %d attempts: %s", g.maxAttempts, strings.Join(failed, ", "))
+		}
+		retried = append(retried, failed...)
+	}
+}
+
+// failedNameIsFlaky reports whether name is eligible for retry: either it was itself marked flaky,
+// or it is the parent of some other failed name that was.  `go test -json` emits a "fail" event
+// for a subtest's parent as well as the subtest itself, but flakytest.Mark can only tag the
+// *testing.T that was actually active -- the subtest's own name -- so a parent test failing solely
+// because its marked subtest failed must not be treated as a new, unmarked failure.
+func failedNameIsFlaky(name string, failed []string, flaky map[string]bool) bool {
+	if flaky[name] {
+		return true
+	}
+	prefix := name + "/"
+	for _, other := range failed {
+		if strings.HasPrefix(other, prefix) && flaky[other] {
+			return true
+		}
+	}
+	return false
+}
+
+type testJSONEvent struct {
+	Action string `json:"Action"`
+	Test   string `json:"Test"`
+	Output string `json:"Output"`
+}
+
+// parseFailedTests reads a `go test -json` stream and returns the names of tests that ultimately
+// failed, along with the set of test names that logged flakyMarker at any point.
+func parseFailedTests(jsonOutput []byte) (failed []string, flaky map[string]bool) {
+	flaky = make(map[string]bool)
+	failedSet := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(jsonOutput))
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		var event testJSONEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			continue
+		}
+		if event.Test == "" {
+			continue
+		}
+		if strings.Contains(event.Output, flakyMarker) {
+			flaky[event.Test] = true
+		}
+		switch event.Action {
+		case "fail":
+			failedSet[event.Test] = true
+		case "pass":
+			delete(failedSet, event.Test)
+		}
+	}
+	for name := range failedSet {
+		failed = append(failed, name)
+	}
+	sort.Strings(failed)
+	return failed, flaky
+}
+
+// testRunPattern builds a -run value that narrows to the full (possibly slash-separated, for
+// subtests) test names in names.  go test's -run splits its argument on unescaped "/" into one
+// regexp per nesting depth, so this builds the same shape: for each depth, an alternation of every
+// distinct name seen at that depth across names.  Since each depth is matched independently, the
+// pattern also matches any combination of those per-depth names (for "TestA/x" and "TestB/y" it
+// also matches "TestA/y"), so it can select more tests than names lists.  Truncating to just the top-level name (the
+// previous behavior) would sweep in every sibling subtest of a failing one on retry, even subtests
+// that were never part of the original failure.
+func testRunPattern(names []string) string {
+	var levels []map[string]bool
+	for _, name := range names {
+		parts := strings.Split(name, "/")
+		for len(levels) < len(parts) {
+			levels = append(levels, make(map[string]bool))
+		}
+		for i, part := range parts {
+			levels[i][part] = true
+		}
+	}
+	segments := make([]string, 0, len(levels))
+	for _, level := range levels {
+		patterns := make([]string, 0, len(level))
+		for name := range level {
+			patterns = append(patterns, regexp.QuoteMeta(name))
+		}
+		sort.Strings(patterns)
+		segments = append(segments, "^("+strings.Join(patterns, "|")+")$")
+	}
+	return strings.Join(segments, "/")
+}
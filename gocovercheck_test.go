@@ -5,6 +5,12 @@ import (
 	"os"
 	"os/exec"
 	"io/ioutil"
+	"path/filepath"
+	"log"
+	"regexp"
+	"strings"
+
+	"golang.org/x/tools/cover"
 )
 
 func TestForFile(t *testing.T) {
@@ -45,3 +51,291 @@ func TestForMyself(t *testing.T) {
 		})
 	})
 }
+
+func TestMergeCoverageProfiles(t *testing.T) {
+	Convey("When merging coverage profiles", t, func() {
+		Convey("should sum counts for blocks that share a position", func() {
+			dir, err := ioutil.TempDir("", "gocovercheck-test")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+
+			profileA := filepath.Join(dir, "a.out")
+			profileB := filepath.Join(dir, "b.out")
+			So(ioutil.WriteFile(profileA, []byte("mode: atomic\nexample.com/foo/bar.go:1.1,3.2 2 1\n"), 0644), ShouldBeNil)
+			So(ioutil.WriteFile(profileB, []byte("mode: atomic\nexample.com/foo/bar.go:1.1,3.2 2 3\n"), 0644), ShouldBeNil)
+
+			out := filepath.Join(dir, "merged.out")
+			So(mergeCoverageProfiles([]string{profileA, profileB}, out), ShouldBeNil)
+
+			merged, err := ioutil.ReadFile(out)
+			So(err, ShouldBeNil)
+			So(string(merged), ShouldEqual, "mode: atomic\nexample.com/foo/bar.go:1.1,3.2 2 4\n")
+		})
+	})
+}
+
+func TestPackagePatternMatches(t *testing.T) {
+	Convey("When matching -per_package_coverage patterns", t, func() {
+		Convey("an exact pattern only matches that directory", func() {
+			So(packagePatternMatches("./foo", "./foo"), ShouldBeTrue)
+			So(packagePatternMatches("./foo/bar", "./foo"), ShouldBeFalse)
+		})
+		Convey("a /... pattern matches the directory and its descendants", func() {
+			So(packagePatternMatches("./foo", "./foo/..."), ShouldBeTrue)
+			So(packagePatternMatches("./foo/bar", "./foo/..."), ShouldBeTrue)
+			So(packagePatternMatches("./foobar", "./foo/..."), ShouldBeFalse)
+		})
+	})
+}
+
+func TestParseGoVersion(t *testing.T) {
+	Convey("When parsing `go env GOVERSION` output", t, func() {
+		Convey("should extract major and minor", func() {
+			major, minor, err := parseGoVersion("go1.21.3\n")
+			So(err, ShouldBeNil)
+			So(major, ShouldEqual, 1)
+			So(minor, ShouldEqual, 21)
+		})
+		Convey("should error on unrecognized output", func() {
+			_, _, err := parseGoVersion("not a version")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestMergeCoverDir(t *testing.T) {
+	Convey("When merging GOCOVERDIR data into an existing coverprofile", t, func() {
+		dir, err := ioutil.TempDir("", "gocovercheck-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		existingProfile := filepath.Join(dir, "existing.out")
+		So(ioutil.WriteFile(existingProfile, []byte("mode: atomic\nexample.com/foo/bar.go:1.1,3.2 2 1\n"), 0644), ShouldBeNil)
+
+		g := gocovercheck{
+			coverprofile: existingProfile,
+			coverDir:     dir,
+			logout:       ioutil.Discard,
+			log:          log.New(ioutil.Discard, "", 0),
+			cmdRun: func(c *exec.Cmd) error {
+				for _, arg := range c.Args {
+					if !strings.HasPrefix(arg, "-o=") {
+						continue
+					}
+					return ioutil.WriteFile(strings.TrimPrefix(arg, "-o="), []byte("mode: atomic\nexample.com/foo/bar.go:1.1,3.2 2 3\n"), 0644)
+				}
+				return nil
+			},
+		}
+		defer g.Close()
+
+		Convey("should sum the existing profile with the covdata output instead of replacing it", func() {
+			So(g.mergeCoverDir(), ShouldBeNil)
+			merged, err := ioutil.ReadFile(g.coverprofile)
+			So(err, ShouldBeNil)
+			So(string(merged), ShouldEqual, "mode: atomic\nexample.com/foo/bar.go:1.1,3.2 2 4\n")
+		})
+	})
+}
+
+func TestParseDiffRanges(t *testing.T) {
+	Convey("When parsing a unified=0 git diff", t, func() {
+		Convey("should collect added line ranges per file", func() {
+			diff := []byte(strings.Join([]string{
+				"diff --git a/foo.go b/foo.go",
+				"--- a/foo.go",
+				"+++ b/foo.go",
+				"@@ -10 +10,2 @@",
+				"+added line one",
+				"+added line two",
+				"diff --git a/bar.go b/dev/null",
+				"--- a/bar.go",
+				"+++ /dev/null",
+				"@@ -1,2 +0,0 @@",
+			}, "\n"))
+			ranges := parseDiffRanges(diff)
+			So(ranges, ShouldResemble, map[string][]lineRange{
+				"foo.go": {{start: 10, end: 11}},
+			})
+		})
+	})
+}
+
+func TestCalculateDiffCoverage(t *testing.T) {
+	Convey("When computing coverage restricted to diff ranges", t, func() {
+		profiles := []*cover.Profile{
+			{
+				FileName: "example.com/foo/bar.go",
+				Blocks: []cover.ProfileBlock{
+					{StartLine: 1, EndLine: 1, NumStmt: 1, Count: 1},
+					{StartLine: 10, EndLine: 10, NumStmt: 1, Count: 0},
+				},
+			},
+		}
+		diffRanges := map[string][]lineRange{
+			"foo/bar.go": {{start: 10, end: 10}},
+		}
+		Convey("only blocks overlapping a changed line count", func() {
+			coverage, uncovered := calculateDiffCoverage(profiles, diffRanges)
+			So(coverage, ShouldEqual, 0)
+			So(uncovered, ShouldResemble, []string{"example.com/foo/bar.go:10"})
+		})
+		Convey("a file with no diff ranges contributes nothing", func() {
+			coverage, uncovered := calculateDiffCoverage(profiles, map[string][]lineRange{})
+			So(coverage, ShouldEqual, 100.0)
+			So(uncovered, ShouldBeNil)
+		})
+	})
+}
+
+func TestBuildCoverageResult(t *testing.T) {
+	Convey("When building a coverage result", t, func() {
+		dir, err := ioutil.TempDir("", "gocovercheck-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		profile := filepath.Join(dir, "merged.out")
+		So(ioutil.WriteFile(profile, []byte(strings.Join([]string{
+			"mode: atomic",
+			"example.com/repo/foo/foo.go:1.1,3.2 2 1",
+			"example.com/repo/foo/foo.go:4.1,6.2 2 0",
+		}, "\n")+"\n"), 0644), ShouldBeNil)
+
+		Convey("a per-package threshold matched via importPathToDir overrides the global requirement", func() {
+			result, err := buildCoverageResult(profile, 0, map[string]float64{"./foo": 90}, map[string]string{"example.com/repo/foo": "./foo"})
+			So(err, ShouldBeNil)
+			So(len(result.Packages), ShouldEqual, 1)
+			So(result.Packages[0].Required, ShouldEqual, 90)
+			So(result.Packages[0].Passed, ShouldBeFalse)
+		})
+		Convey("without an importPathToDir mapping the threshold never matches the import-path name", func() {
+			result, err := buildCoverageResult(profile, 0, map[string]float64{"./foo": 90}, nil)
+			So(err, ShouldBeNil)
+			So(result.Packages[0].Required, ShouldEqual, 0)
+		})
+	})
+}
+
+func TestCoberturaCoverageReport(t *testing.T) {
+	Convey("When building a cobertura report", t, func() {
+		result := &coverageResult{
+			Coverage: 50,
+			Files:    []fileCoverageResult{{FileName: "example.com/repo/foo/foo.go", Statements: 2, Covered: 1}},
+			Packages: []packageCoverageResult{{Name: "example.com/repo/foo", Statements: 2, Covered: 1}},
+		}
+		body, err := coberturaCoverageReport(result)
+		So(err, ShouldBeNil)
+		Convey("should include the package's classes", func() {
+			So(string(body), ShouldContainSubstring, `name="example.com/repo/foo"`)
+			So(string(body), ShouldContainSubstring, `filename="example.com/repo/foo/foo.go"`)
+		})
+	})
+}
+
+func TestJunitCoverageReport(t *testing.T) {
+	Convey("When building a junit report", t, func() {
+		Convey("a failing package gets a failure element", func() {
+			result := &coverageResult{
+				Packages: []packageCoverageResult{{Name: "example.com/repo/foo", Coverage: 10, Required: 90, Passed: false}},
+			}
+			body, err := junitCoverageReport(result)
+			So(err, ShouldBeNil)
+			So(string(body), ShouldContainSubstring, "<failure")
+		})
+		Convey("a passing package gets no failure element", func() {
+			result := &coverageResult{
+				Packages: []packageCoverageResult{{Name: "example.com/repo/foo", Coverage: 100, Required: 90, Passed: true}},
+			}
+			body, err := junitCoverageReport(result)
+			So(err, ShouldBeNil)
+			So(string(body), ShouldNotContainSubstring, "<failure")
+		})
+	})
+}
+
+func TestTestRunPattern(t *testing.T) {
+	Convey("When building a -run pattern from failed test names", t, func() {
+		Convey("a single top-level test matches just that test", func() {
+			So(testRunPattern([]string{"TestFoo"}), ShouldEqual, "^(TestFoo)$")
+		})
+		Convey("a failing subtest keeps its subtest name instead of truncating to the parent", func() {
+			pattern := testRunPattern([]string{"TestFoo/sub1"})
+			So(pattern, ShouldEqual, "^(TestFoo)$/^(sub1)$")
+
+			matched, err := regexp.MatchString(strings.Split(pattern, "/")[1], "sub2")
+			So(err, ShouldBeNil)
+			So(matched, ShouldBeFalse)
+		})
+		Convey("multiple failing names are deduped and sorted per level", func() {
+			pattern := testRunPattern([]string{"TestFoo/sub1", "TestFoo/sub1", "TestBar"})
+			So(pattern, ShouldEqual, "^(TestBar|TestFoo)$/^(sub1)$")
+		})
+	})
+}
+
+func TestParseFailedTests(t *testing.T) {
+	Convey("When parsing `go test -json` output", t, func() {
+		Convey("should report tests that failed and stay failed, and which logged the flaky marker", func() {
+			events := []string{
+				`{"Action":"fail","Test":"TestA"}`,
+				`{"Action":"run","Test":"TestB"}`,
+				`{"Action":"output","Test":"TestB","Output":"flakytest: marked as flaky, see http://example.com\n"}`,
+				`{"Action":"fail","Test":"TestB"}`,
+				`{"Action":"run","Test":"TestC"}`,
+				`{"Action":"fail","Test":"TestC"}`,
+				`{"Action":"pass","Test":"TestC"}`,
+			}
+			failed, flaky := parseFailedTests([]byte(strings.Join(events, "\n") + "\n"))
+			So(failed, ShouldResemble, []string{"TestA", "TestB"})
+			So(flaky, ShouldResemble, map[string]bool{"TestB": true})
+		})
+		Convey("a failing subtest also fails its parent, which only the subtest can mark flaky", func() {
+			events := []string{
+				`{"Action":"run","Test":"TestParent"}`,
+				`{"Action":"run","Test":"TestParent/sub1"}`,
+				`{"Action":"output","Test":"TestParent/sub1","Output":"flakytest: marked as flaky, see http://example.com\n"}`,
+				`{"Action":"fail","Test":"TestParent/sub1"}`,
+				`{"Action":"fail","Test":"TestParent"}`,
+			}
+			failed, flaky := parseFailedTests([]byte(strings.Join(events, "\n") + "\n"))
+			So(failed, ShouldResemble, []string{"TestParent", "TestParent/sub1"})
+			So(flaky, ShouldResemble, map[string]bool{"TestParent/sub1": true})
+		})
+	})
+}
+
+func TestFailedNameIsFlaky(t *testing.T) {
+	Convey("When deciding whether a failed test is eligible for retry", t, func() {
+		Convey("a name marked flaky directly is eligible", func() {
+			So(failedNameIsFlaky("TestA", []string{"TestA"}, map[string]bool{"TestA": true}), ShouldBeTrue)
+		})
+		Convey("a parent whose only failing child was marked flaky is eligible", func() {
+			failed := []string{"TestParent", "TestParent/sub1"}
+			flaky := map[string]bool{"TestParent/sub1": true}
+			So(failedNameIsFlaky("TestParent", failed, flaky), ShouldBeTrue)
+			So(failedNameIsFlaky("TestParent/sub1", failed, flaky), ShouldBeTrue)
+		})
+		Convey("an unrelated failing test is not made eligible by another test's marker", func() {
+			failed := []string{"TestOther", "TestParent/sub1"}
+			flaky := map[string]bool{"TestParent/sub1": true}
+			So(failedNameIsFlaky("TestOther", failed, flaky), ShouldBeFalse)
+		})
+	})
+}
+
+func TestResolvePackageDirsRecursiveSingleDir(t *testing.T) {
+	Convey("When a recursive argument expands to a single directory", t, func() {
+		dir, err := ioutil.TempDir("", "gocovercheck-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		So(ioutil.WriteFile(filepath.Join(dir, "foo.go"), []byte("package foo\n"), 0644), ShouldBeNil)
+
+		g := gocovercheck{cmdArgs: []string{dir + "/..."}}
+		dirs, recursive, err := g.resolvePackageDirs()
+		So(err, ShouldBeNil)
+		So(len(dirs), ShouldEqual, 1)
+		Convey("it still reports recursive so -per_package_coverage is evaluated", func() {
+			So(recursive, ShouldBeTrue)
+		})
+	})
+}